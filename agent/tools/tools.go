@@ -0,0 +1,190 @@
+// The tools package manages the agent's on-disk cache of juju tools:
+// where a given version lives, and how a downloaded archive gets there
+// safely.
+package tools
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/juju-core/environs"
+	"launchpad.net/juju-core/version"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// toolsFile is the name of the file in a tools directory that records
+// the metadata of the tools that were unpacked there.
+const toolsFile = "downloaded-tools.txt"
+
+// SharedToolsDir returns the directory used to store binaries for the
+// given version of the juju tools, relative to dataDir.
+func SharedToolsDir(dataDir string, v version.Version) string {
+	return filepath.Join(dataDir, "tools", v.String())
+}
+
+// ToolsDir returns the directory that is, or will be, symlinked to the
+// shared tools directory currently in use by the given agent.
+func ToolsDir(dataDir, agentName string) string {
+	return filepath.Join(dataDir, "tools", agentName)
+}
+
+// downloadedTools is the manifest written to a shared tools directory
+// once its archive has been fully extracted there. Its presence is
+// what lets ReadTools tell a completed download from one that never
+// finished, so a crash mid-extract cannot masquerade as a cached
+// version that is safe to use.
+type downloadedTools struct {
+	Version version.Version `json:"version"`
+	URL     string          `json:"url"`
+	SHA256  string          `json:"sha256"`
+	Size    int64           `json:"size"`
+}
+
+// ReadTools checks that the tools for the given version have already
+// been unpacked under dataDir, and returns an *environs.Tools built
+// from the manifest recorded there. It fails if the shared directory
+// does not exist or has no manifest, which is also the state left
+// behind by a download that never completed.
+func ReadTools(dataDir string, v version.Version) (*environs.Tools, error) {
+	dir := SharedToolsDir(dataDir, v)
+	data, err := ioutil.ReadFile(filepath.Join(dir, toolsFile))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read tools metadata in tools directory %q: %v", dir, err)
+	}
+	var t downloadedTools
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("invalid tools metadata in tools directory %q: %v", dir, err)
+	}
+	if t.Version != v {
+		return nil, fmt.Errorf("tools metadata in %q is for version %v, not %v", dir, t.Version, v)
+	}
+	return &environs.Tools{
+		Version: t.Version,
+		URL:     t.URL,
+		SHA256:  t.SHA256,
+		Size:    t.Size,
+	}, nil
+}
+
+// UnpackTools reads a gzipped tar archive from r and atomically
+// unpacks it into the shared tools directory for tools.Version,
+// alongside a downloaded-tools.txt manifest recording tools' URL,
+// size and SHA-256 checksum. It extracts into a temporary directory
+// first and renames it into place only once extraction (and, when
+// tools.SHA256 is set, checksum verification) has succeeded, so a
+// failed or interrupted download never leaves a partial version
+// directory for ReadTools to trip over.
+func UnpackTools(dataDir string, tools *environs.Tools, r io.Reader) (err error) {
+	toolsParent := filepath.Join(dataDir, "tools")
+	if err := os.MkdirAll(toolsParent, 0755); err != nil {
+		return fmt.Errorf("cannot create tools directory: %v", err)
+	}
+	tmpDir, err := ioutil.TempDir(toolsParent, "unpacking-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	h := sha256.New()
+	hashed := io.TeeReader(r, h)
+	if err := extractTarGz(hashed, tmpDir); err != nil {
+		return err
+	}
+	// The gzip and tar readers can stop before the end of the archive
+	// (the gzip trailer, for one), so hash whatever they left unread.
+	if _, err := io.Copy(ioutil.Discard, hashed); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if tools.SHA256 != "" && sum != tools.SHA256 {
+		return fmt.Errorf("tools at %q failed checksum verification: got %s, want %s", tools.URL, sum, tools.SHA256)
+	}
+
+	data, err := json.Marshal(&downloadedTools{
+		Version: tools.Version,
+		URL:     tools.URL,
+		SHA256:  sum,
+		Size:    tools.Size,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, toolsFile), data, 0644); err != nil {
+		return err
+	}
+
+	toolsDir := SharedToolsDir(dataDir, tools.Version)
+	if err := os.RemoveAll(toolsDir); err != nil {
+		return fmt.Errorf("cannot remove existing tools directory: %v", err)
+	}
+	if err := os.Rename(tmpDir, toolsDir); err != nil {
+		return fmt.Errorf("cannot rename new tools directory into place: %v", err)
+	}
+	return nil
+}
+
+// extractTarGz extracts the gzipped tar archive read from r into dir.
+func extractTarGz(r io.Reader, dir string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("cannot unzip tools archive: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.Contains(hdr.Name, "/\\") {
+			return fmt.Errorf("bad name %q in tools archive", hdr.Name)
+		}
+		name := filepath.Join(dir, hdr.Name)
+		if err := writeFile(name, os.FileMode(hdr.Mode&0777), tr); err != nil {
+			return fmt.Errorf("tar extract %q failed: %v", name, err)
+		}
+	}
+}
+
+func writeFile(name string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// ChangeAgentTools atomically repoints the given agent's tools
+// directory at the shared tools for version v, so that an upgrade (or
+// downgrade) takes effect as a single filesystem rename rather than a
+// window in which the agent's tools directory is missing or partial.
+// It fails if the tools for v have not already been unpacked with
+// UnpackTools.
+func ChangeAgentTools(dataDir string, agentName string, v version.Version) error {
+	if _, err := ReadTools(dataDir, v); err != nil {
+		return err
+	}
+	toolsDir := ToolsDir(dataDir, agentName)
+	tmpName := toolsDir + ".new"
+	if err := os.Remove(tmpName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(v.String(), tmpName); err != nil {
+		return fmt.Errorf("cannot create tools symlink: %v", err)
+	}
+	if err := os.Rename(tmpName, toolsDir); err != nil {
+		return fmt.Errorf("cannot update tools symlink: %v", err)
+	}
+	return nil
+}
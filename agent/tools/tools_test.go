@@ -0,0 +1,104 @@
+package tools
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"launchpad.net/juju-core/environs"
+	"launchpad.net/juju-core/version"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadToolsFailsBeforeUnpack(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "tools-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	v := version.Version{Major: 1, Minor: 2, Patch: 3}
+	if _, err := ReadTools(dataDir, v); err == nil {
+		t.Fatal("expected ReadTools to fail before UnpackTools has run")
+	}
+}
+
+func TestUnpackAndReadToolsRoundTrip(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "tools-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	v := version.Version{Major: 1, Minor: 2, Patch: 3}
+	archive := mkTarGz(t, "jujud", "fake binary contents")
+	tools := &environs.Tools{Version: v, URL: "http://example.com/tools.tgz"}
+	if err := UnpackTools(dataDir, tools, bytes.NewReader(archive)); err != nil {
+		t.Fatalf("UnpackTools failed: %v", err)
+	}
+
+	got, err := ReadTools(dataDir, v)
+	if err != nil {
+		t.Fatalf("ReadTools failed after UnpackTools: %v", err)
+	}
+	if got.Version != v || got.URL != tools.URL || got.SHA256 == "" {
+		t.Fatalf("unexpected tools metadata: %#v", got)
+	}
+
+	if _, err := os.Stat(filepath.Join(SharedToolsDir(dataDir, v), "jujud")); err != nil {
+		t.Fatalf("expected extracted binary to exist: %v", err)
+	}
+}
+
+func TestChangeAgentToolsSymlinksToSharedDir(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "tools-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	v := version.Version{Major: 1, Minor: 2, Patch: 3}
+	archive := mkTarGz(t, "jujud", "fake binary contents")
+	tools := &environs.Tools{Version: v, URL: "http://example.com/tools.tgz"}
+	if err := UnpackTools(dataDir, tools, bytes.NewReader(archive)); err != nil {
+		t.Fatalf("UnpackTools failed: %v", err)
+	}
+
+	if err := ChangeAgentTools(dataDir, "machine-0", v); err != nil {
+		t.Fatalf("ChangeAgentTools failed: %v", err)
+	}
+	target, err := os.Readlink(ToolsDir(dataDir, "machine-0"))
+	if err != nil {
+		t.Fatalf("expected a tools symlink: %v", err)
+	}
+	if target != v.String() {
+		t.Fatalf("expected symlink to point at %q, got %q", v.String(), target)
+	}
+}
+
+// mkTarGz builds a minimal gzipped tar archive containing a single file.
+func mkTarGz(t *testing.T, name, contents string) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tarw := tar.NewWriter(gzw)
+	hdr := &tar.Header{
+		Name: name,
+		Mode: 0755,
+		Size: int64(len(contents)),
+	}
+	if err := tarw.WriteHeader(hdr); err != nil {
+		t.Fatalf("cannot write tar header: %v", err)
+	}
+	if _, err := tarw.Write([]byte(contents)); err != nil {
+		t.Fatalf("cannot write tar contents: %v", err)
+	}
+	if err := tarw.Close(); err != nil {
+		t.Fatalf("cannot close tar writer: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("cannot close gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
@@ -2,7 +2,12 @@ package environs
 
 import (
 	"archive/tar"
+	"bytes"
+	"code.google.com/p/go.crypto/openpgp"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,24 +33,184 @@ type Tools struct {
 	Arch string
 	Series string
 	URL string
+
+	// Size and SHA256 are hydrated from the tools' manifest, when one
+	// has been published alongside the archive. They are zero/empty
+	// when no manifest was found.
+	Size   int64
+	SHA256 string
+}
+
+// Manifest is the JSON document published alongside a tools archive
+// at ManifestPath, recording enough information for a downloader
+// (such as agent/tools.UnpackTools) to verify what it fetches.
+type Manifest struct {
+	Version version.Version `json:"version"`
+	Series  string          `json:"series"`
+	Arch    string          `json:"arch"`
+	Size    int64           `json:"size"`
+	SHA256  string          `json:"sha256"`
+	URL     string          `json:"url"`
+}
+
+// ManifestPath returns the path that is used to store and retrieve
+// the manifest describing the tools archive at the given version,
+// series and architecture.
+func ManifestPath(v version.Version, series, arch string) string {
+	return fmt.Sprintf(toolPrefix+"%v-%s-%s.json", v, series, arch)
+}
+
+// SigningKeyring, if set, names an armored GPG secret keyring file.
+// When set, PutTools detach-signs each manifest it publishes with
+// the keyring's first key, and uploads the signature alongside the
+// manifest as "<manifest>.asc". It is unset by default, in which
+// case manifests are published unsigned.
+var SigningKeyring string
+
+// VerificationKeyring, if set, names an armored GPG public keyring
+// file. When set, checkDetachedSignature (via verifyStoredSignature
+// and verifyDetachedSignature) checks a document's signature against
+// it before its contents (a manifest or a simplestreams-style tools
+// index) can be trusted. It is unset by default, in which case
+// manifests and indexes are trusted unsigned.
+var VerificationKeyring string
+
+// List holds tools found by ListTools, BestTools and friends. Use its
+// Match method to narrow it down to the tools a caller actually wants.
+type List []*Tools
+
+// NoFilter means a Filter field of the same type should not restrict
+// a match. In particular, a MinorVersion of NoFilter lets callers
+// list "all v1.* tools" across both released and development builds
+// for upgrade planning, which selecting on MajorVersion alone cannot
+// express.
+const NoFilter = -1
+
+// Filter holds criteria for selecting a subset of a List. Empty
+// strings, a zero Number, a false Released and int fields set to
+// NoFilter do not restrict the match; an int field left at 0 matches
+// only version 0.
+type Filter struct {
+	// Number, if its Major field is non-zero, restricts the match to
+	// this exact version.
+	Number version.Version
+
+	// MajorVersion, if not NoFilter, restricts the match to tools
+	// with this major version.
+	MajorVersion int
+
+	// MinorVersion, if not NoFilter, restricts the match to tools
+	// with this minor version.
+	MinorVersion int
+
+	// Series, if non-empty, restricts the match to tools built for
+	// this series.
+	Series string
+
+	// Arch, if non-empty, restricts the match to tools built for
+	// this architecture.
+	Arch string
+
+	// Released, if true, excludes development tools - those with an
+	// odd minor version number, by juju's version scheme.
+	Released bool
+}
+
+// Match returns the tools in l that satisfy f.
+func (l List) Match(f Filter) List {
+	var result List
+	for _, t := range l {
+		if f.Number.Major != 0 && t.Version != f.Number {
+			continue
+		}
+		if f.MajorVersion != NoFilter && t.Version.Major != f.MajorVersion {
+			continue
+		}
+		if f.MinorVersion != NoFilter && t.Version.Minor != f.MinorVersion {
+			continue
+		}
+		if f.Series != "" && t.Series != f.Series {
+			continue
+		}
+		if f.Arch != "" && t.Arch != f.Arch {
+			continue
+		}
+		if f.Released && t.Version.Minor%2 != 0 {
+			continue
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+// Newest returns the tools in l with the highest version number,
+// along with that version. If l is empty, it returns a nil List and
+// the zero version.
+func (l List) Newest() (List, version.Version) {
+	var result List
+	var best version.Version
+	for _, t := range l {
+		if best.Less(t.Version) {
+			best = t.Version
+			result = List{t}
+		} else if t.Version == best {
+			result = append(result, t)
+		}
+	}
+	return result, best
+}
+
+// URLs returns a map from version to URL, taking for each distinct
+// version the URL of the last tools in l with that version.
+func (l List) URLs() map[version.Version]string {
+	result := make(map[version.Version]string)
+	for _, t := range l {
+		result[t.Version] = t.URL
+	}
+	return result
+}
+
+// AllSeries returns the set of series for which l holds tools.
+func (l List) AllSeries() []string {
+	return l.collect(func(t *Tools) string { return t.Series })
+}
+
+// AllArches returns the set of architectures for which l holds tools.
+func (l List) AllArches() []string {
+	return l.collect(func(t *Tools) string { return t.Arch })
+}
+
+// collect returns the distinct values of pick(t) across l, in the
+// order they are first seen.
+func (l List) collect(pick func(*Tools) string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, t := range l {
+		v := pick(t)
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
 }
 
 // ListTools returns all the tools found in the given storage
 // that have the given major version.
-func ListTools(store StorageReader, majorVersion int) ([]Tools, error) {
+func ListTools(store StorageReader, majorVersion int) (List, error) {
 	dir := fmt.Sprintf("%s%d.", toolPrefix, majorVersion)
 	names, err := store.List(dir)
 	if err != nil {
 		return nil, err
 	}
-	var tools []Tools
+	var tools List
 	for _, name := range names {
 		m := toolFilePat.FindStringSubmatch(name)
 		if m == nil {
 			log.Printf("unexpected tools file found %q", name)
 			continue
 		}
-		var t Tools
+		t := &Tools{}
 		t.Version, err = version.Parse(m[1])
 		if err != nil {
 			log.Printf("failed to parse version %q: %v", name, err)
@@ -62,11 +227,48 @@ func ListTools(store StorageReader, majorVersion int) ([]Tools, error) {
 			log.Printf("cannot get URL for %q: %v", name, err)
 			continue
 		}
+		if err := hydrateManifest(store, name, t); err != nil {
+			return nil, err
+		}
 		tools = append(tools, t)
 	}
 	return tools, nil
 }
 
+// hydrateManifest fills in t.Size and t.SHA256 from the manifest
+// published alongside the tools archive at name, if any. It is not
+// an error for no manifest to exist; older uploads have none, and t
+// is simply left with its legacy zero values. If VerificationKeyring
+// is set, it verifies the manifest's signature and returns a hard
+// error if that check fails, rather than hydrating t from a manifest
+// that cannot be trusted.
+func hydrateManifest(store StorageReader, name string, t *Tools) error {
+	manifestPath := strings.TrimSuffix(name, ".tgz") + ".json"
+	r, err := store.Get(manifestPath)
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Printf("cannot read manifest for %q: %v", name, err)
+		return nil
+	}
+	if VerificationKeyring != "" {
+		if err := verifyStoredSignature(store, manifestPath, data); err != nil {
+			return fmt.Errorf("manifest for %q failed signature verification: %v", name, err)
+		}
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		log.Printf("cannot parse manifest for %q: %v", name, err)
+		return nil
+	}
+	t.Size = m.Size
+	t.SHA256 = m.SHA256
+	return nil
+}
+
 // ToolsPath returns the path that is used to store and
 // retrieve the juju tools in a Storage.
 func ToolsPath(v version.Version, series, arch string) string {
@@ -74,34 +276,183 @@ func ToolsPath(v version.Version, series, arch string) string {
 }
 
 // PutTools uploads the current version of the juju tools
-// executables to the given storage.
+// executables to the given storage, together with a manifest
+// recording their SHA-256 checksum and size so that a downloader can
+// verify what it later fetches. If SigningKeyring is set, the
+// manifest is also detach-signed and the signature uploaded
+// alongside it.
 // TODO find binaries from $PATH when not using a development
 // version of juju within a $GOPATH.
 func PutTools(storage StorageWriter) error {
+	_, err := putTools(storage, config.CurrentSeries)
+	return err
+}
+
+// PutToolsForSeries uploads the current version of the juju tools as
+// PutTools does, then aliases the uploaded archive (and its manifest)
+// under ToolsPath for each series in extraSeries. This lets an
+// uploader declare "this binary also works on precise, quantal,
+// trusty" without rebuilding and re-uploading once per series: today
+// findToolsPath and ListTools key on an exact series match, so a host
+// running e.g. trusty cannot boot from a precise build even though
+// the two are ABI-compatible. extraSeries is rejected wholesale if it
+// contains a series juju does not know to be ABI-compatible with
+// config.CurrentSeries.
+//
+// Exposing this as a "--series" flag on the upload-tools command is
+// left for whoever wires up that command; this tree has no cmd/
+// package implementing it yet.
+func PutToolsForSeries(storage StorageWriter, extraSeries []string) error {
+	for _, series := range extraSeries {
+		if !seriesCompatible(series, config.CurrentSeries, true) {
+			return fmt.Errorf("series %q is not known to be ABI-compatible with %q", series, config.CurrentSeries)
+		}
+	}
+	data, err := putTools(storage, config.CurrentSeries)
+	if err != nil {
+		return err
+	}
+	for _, series := range extraSeries {
+		if series == config.CurrentSeries {
+			continue
+		}
+		p := ToolsPath(version.Current, series, config.CurrentArch)
+		log.Printf("environs: aliasing tools %v", p)
+		if err := storage.Put(p, bytes.NewReader(data.archive), int64(len(data.archive))); err != nil {
+			return err
+		}
+		url, err := storage.URL(p)
+		if err != nil {
+			return err
+		}
+		if err := putManifest(storage, version.Current, series, config.CurrentArch, data.size, data.sha256, url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ubuntuSeries lists, oldest first, the Ubuntu series whose juju
+// agent binaries are known to be ABI-compatible with one another.
+// PutToolsForSeries consults it to decide which aliasing requests it
+// can vouch for.
+var ubuntuSeries = []string{"precise", "quantal", "raring", "saucy", "trusty"}
+
+// isKnownSeries reports whether series is one juju knows to be
+// ABI-compatible with the rest of ubuntuSeries.
+func isKnownSeries(series string) bool {
+	for _, s := range ubuntuSeries {
+		if s == series {
+			return true
+		}
+	}
+	return false
+}
+
+// builtTools holds an in-memory built tools archive together with
+// the metadata PutTools and PutToolsForSeries need to publish it.
+type builtTools struct {
+	archive []byte
+	size    int64
+	sha256  string
+}
+
+// putTools builds the current version of the juju tools executables,
+// uploads them to storage under the given series, and publishes a
+// manifest alongside them. It returns the built archive so that
+// callers such as PutToolsForSeries can alias it under other series
+// without rebuilding.
+func putTools(storage StorageWriter, series string) (*builtTools, error) {
 	// We create the entire archive before asking the environment to
 	// start uploading so that we can be sure we have archived
 	// correctly.
 	f, err := ioutil.TempFile("", "juju-tgz")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 	defer os.Remove(f.Name())
-	err = bundleTools(f)
+	if err := bundleTools(f); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	bt := &builtTools{
+		archive: data,
+		size:    int64(len(data)),
+		sha256:  hex.EncodeToString(sum[:]),
+	}
+	p := ToolsPath(version.Current, series, config.CurrentArch)
+	log.Printf("environs: putting tools %v", p)
+	if err := storage.Put(p, bytes.NewReader(bt.archive), bt.size); err != nil {
+		return nil, err
 	}
-	_, err = f.Seek(0, 0)
+	url, err := storage.URL(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := putManifest(storage, version.Current, series, config.CurrentArch, bt.size, bt.sha256, url); err != nil {
+		return nil, err
+	}
+	return bt, nil
+}
+
+// putManifest writes the manifest for the tools archive at the given
+// version, series and arch, signing it with SigningKeyring if one is
+// configured.
+func putManifest(storage StorageWriter, v version.Version, series, arch string, size int64, sha256sum, url string) error {
+	manifest := Manifest{
+		Version: v,
+		Series:  series,
+		Arch:    arch,
+		Size:    size,
+		SHA256:  sha256sum,
+		URL:     url,
+	}
+	data, err := json.Marshal(&manifest)
 	if err != nil {
 		return err
 	}
-	fi, err := f.Stat()
+	mp := ManifestPath(v, series, arch)
+	if err := storage.Put(mp, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	if SigningKeyring == "" {
+		return nil
+	}
+	sig, err := signManifest(data)
 	if err != nil {
 		return err
 	}
-	p := ToolsPath(version.Current, config.CurrentSeries, config.CurrentArch)
-	log.Printf("environs: putting tools %v", p)
-	return storage.Put(p, f, fi.Size())
+	return storage.Put(mp+".asc", bytes.NewReader(sig), int64(len(sig)))
+}
+
+// signManifest returns an armored detached signature of data, made
+// with the first secret key found in SigningKeyring.
+func signManifest(data []byte) ([]byte, error) {
+	keyringFile, err := os.Open(SigningKeyring)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open signing keyring: %v", err)
+	}
+	defer keyringFile.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(keyringFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read signing keyring: %v", err)
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("signing keyring %q contains no keys", SigningKeyring)
+	}
+	var buf bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&buf, keyring[0], bytes.NewReader(data), nil); err != nil {
+		return nil, fmt.Errorf("cannot sign manifest: %v", err)
+	}
+	return buf.Bytes(), nil
 }
 
 // archive writes the executable files found in the given directory in
@@ -185,63 +536,158 @@ type toolsSpec struct {
 	arch   string
 }
 
-// BestTools the most recent tools compatible with the
-// given version, series and architecture. It returns *NotFoundError
-// if no tools were found.
-func BestTools(toolsList []Tools, version version.Version, series, arch string) (*Tools, error) {
-	var bestTools *Tools
-	for _, t := range toolsList {
-		t := t
-		if t.Version.Major != version.Major ||
-			t.Series != series ||
-			t.Arch != arch {
-			continue
+// Preferences controls how BestTools matches tools in a List against
+// a requested version, series and architecture, and how far it may
+// relax that match when no exact candidate exists.
+type Preferences struct {
+	Version version.Version
+	Series  string
+	Arch    string
+
+	// AllowArchFallback permits an i386 archive to satisfy an amd64
+	// request when no exact amd64 match exists. It is never the
+	// other way around: an i386 host cannot run amd64 binaries.
+	AllowArchFallback bool
+
+	// AllowSeriesFallback permits tools built for a different but
+	// ABI-compatible Ubuntu series (see ubuntuSeries) to satisfy the
+	// request when no exact series match exists - e.g. falling back
+	// to a precise build for a trusty host.
+	AllowSeriesFallback bool
+}
+
+// archCompatible reports whether an archive built for have can
+// satisfy a request for want, given whether arch fallback is allowed.
+func archCompatible(have, want string, allowFallback bool) bool {
+	if have == want {
+		return true
+	}
+	return allowFallback && want == "amd64" && have == "i386"
+}
+
+// seriesCompatible reports whether an archive built for have can
+// satisfy a request for want, given whether series fallback is
+// allowed.
+func seriesCompatible(have, want string, allowFallback bool) bool {
+	if have == want {
+		return true
+	}
+	return allowFallback && isKnownSeries(have) && isKnownSeries(want)
+}
+
+// fallbackLevel is one rung of the compatibility matrix BestTools
+// walks, from an exact match down to the most relaxed match prefs
+// allows.
+type fallbackLevel struct {
+	archFallback   bool
+	seriesFallback bool
+}
+
+// levels returns the fallback levels prefs allows, strictest first,
+// so that an exact match always wins over a relaxed one and a
+// single-axis fallback always wins over a two-axis one.
+func (prefs Preferences) levels() []fallbackLevel {
+	levels := []fallbackLevel{{false, false}}
+	if prefs.AllowArchFallback {
+		levels = append(levels, fallbackLevel{true, false})
+	}
+	if prefs.AllowSeriesFallback {
+		levels = append(levels, fallbackLevel{false, true})
+	}
+	if prefs.AllowArchFallback && prefs.AllowSeriesFallback {
+		levels = append(levels, fallbackLevel{true, true})
+	}
+	return levels
+}
+
+// BestTools returns the newest tools in toolsList compatible with
+// prefs, together with whether the match required falling back to a
+// different architecture or series than the one requested. It
+// returns *NotFoundError if no tools satisfy prefs even with
+// fallbacks applied.
+func BestTools(toolsList List, prefs Preferences) (*Tools, bool, error) {
+	for _, lvl := range prefs.levels() {
+		var matches List
+		for _, t := range toolsList {
+			if t.Version.Major != prefs.Version.Major {
+				continue
+			}
+			if !seriesCompatible(t.Series, prefs.Series, lvl.seriesFallback) {
+				continue
+			}
+			if !archCompatible(t.Arch, prefs.Arch, lvl.archFallback) {
+				continue
+			}
+			matches = append(matches, t)
 		}
-		if bestTools == nil || bestTools.Version.Less(t.Version) {
-			bestTools = &t
+		if newest, _ := matches.Newest(); len(newest) > 0 {
+			return newest[0], lvl.archFallback || lvl.seriesFallback, nil
 		}
 	}
-	if bestTools == nil {
-		return nil, &NotFoundError{fmt.Errorf("no compatible tools found")}
-	}
-	return bestTools, nil
+	return nil, false, &NotFoundError{fmt.Errorf("no compatible tools found")}
 }
 
-// GetTools fetches tools from the given URL and downloads them into the given directory.
-func GetTools(url, dir string) error {
-	resp, err := http.Get(url)
+// verifyDetachedSignature fetches the detached signature published
+// over HTTP at docURL+".asc" and checks it against data using
+// VerificationKeyring. It is used to authenticate the
+// simplestreams-style indexes an httpToolsSource reads; tools
+// manifests are authenticated by verifyStoredSignature instead, since
+// they are fetched through a StorageReader rather than plain HTTP.
+func verifyDetachedSignature(docURL string, data []byte) error {
+	resp, err := http.Get(docURL + ".asc")
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot fetch signature: %v", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("no signature published at %q.asc", docURL)
+	}
+	return checkDetachedSignature(data, resp.Body)
+}
 
-	r, err := gzip.NewReader(resp.Body)
+// verifyStoredSignature fetches the detached signature published
+// alongside path (at path+".asc") in store and checks it against data
+// using VerificationKeyring. It is used by hydrateManifest to
+// authenticate tools manifests read from environment or public
+// storage.
+func verifyStoredSignature(store StorageReader, path string, data []byte) error {
+	r, err := store.Get(path + ".asc")
 	if err != nil {
-		return err
+		return fmt.Errorf("no signature published at %q.asc: %v", path, err)
 	}
 	defer r.Close()
+	return checkDetachedSignature(data, r)
+}
 
-	tr := tar.NewReader(r)
-	for {
-		hdr, err := tr.Next()
-		if err != nil {
-			if err == io.EOF {
-				err = nil
-			}
-			return err
-		}
-		if strings.Contains(hdr.Name, "/\\") {
-			return fmt.Errorf("bad name %q in tools archive", hdr.Name)
-		}
-
-		name := filepath.Join(dir, hdr.Name)
-		if err := writeFile(name, os.FileMode(hdr.Mode&0777), tr); err != nil {
-			return fmt.Errorf("tar extract %q failed: %v", name, err)
-		}
+// checkDetachedSignature verifies that sig is a valid detached
+// signature of data, using VerificationKeyring.
+func checkDetachedSignature(data []byte, sig io.Reader) error {
+	keyringFile, err := os.Open(VerificationKeyring)
+	if err != nil {
+		return fmt.Errorf("cannot open verification keyring: %v", err)
+	}
+	defer keyringFile.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(keyringFile)
+	if err != nil {
+		return fmt.Errorf("cannot read verification keyring: %v", err)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), sig); err != nil {
+		return fmt.Errorf("signature verification failed: %v", err)
 	}
-	panic("not reached")
+	return nil
 }
 
+// ExternalToolsSources holds additional ToolsSources that findTools
+// consults, in order, after both environment storage and public
+// storage have failed to yield a match. It lets operators point juju
+// at a private mirror or an air-gapped internal index without
+// repackaging it into their environment's own PublicStorage.
+//
+// Nothing in this tree populates it yet: wiring it up from a
+// "tools-metadata-url"-style setting in environs/config is left to
+// whichever Environ implementation adds that setting.
+var ExternalToolsSources []ToolsSource
+
 // findToolsPath is an internal version of FindTools that returns the
 // storage where the tools were found, and the path within that storage.
 func findTools(env Environ, spec toolsSpec) (storage StorageReader, path string, err error) {
@@ -251,54 +697,62 @@ func findTools(env Environ, spec toolsSpec) (storage StorageReader, path string,
 		storage = env.PublicStorage()
 		path, err = findToolsPath(storage, spec)
 	}
+	if _, ok := err.(*NotFoundError); ok {
+		if s, p, ok := findToolsFromSources(ExternalToolsSources, spec); ok {
+			return s, p, nil
+		}
+	}
 	if err != nil {
 		return nil, "", err
 	}
 	return
 }
 
-// findToolsPath looks for the tools in the given storage.
-func findToolsPath(store StorageReader, spec toolsSpec) (path string, err error) {
-	names, err := store.List(fmt.Sprintf("%s%d.", toolPrefix, spec.vers.Major))
-	log.Printf("findTools searching for %v in %q", spec, names)
-	if err != nil {
-		return "", err
-	}
-	if len(names) == 0 {
-		return "", &NotFoundError{fmt.Errorf("no compatible tools found")}
+// findToolsFromSources consults each source in turn for tools
+// matching spec, returning the first match found.
+func findToolsFromSources(sources []ToolsSource, spec toolsSpec) (storage StorageReader, path string, ok bool) {
+	filter := Filter{
+		MajorVersion: spec.vers.Major,
+		MinorVersion: NoFilter,
+		Series:       spec.series,
+		Arch:         spec.arch,
 	}
-	bestVersion := version.Version{Major: -1}
-	bestName := ""
-	for _, name := range names {
-		m := toolFilePat.FindStringSubmatch(name)
-		if m == nil {
-			log.Printf("unexpected tools file found %q", name)
-			continue
-		}
-		vers, err := version.Parse(m[1])
+	for _, src := range sources {
+		list, err := src.Fetch(filter)
 		if err != nil {
-			log.Printf("failed to parse version %q: %v", name, err)
-			continue
-		}
-		if m[2] != spec.series {
+			log.Printf("cannot fetch tools from external source: %v", err)
 			continue
 		}
-		// TODO allow different architectures.
-		if m[3] != spec.arch {
+		newest, vers := list.Newest()
+		if len(newest) == 0 {
 			continue
 		}
-		if vers.Major != spec.vers.Major {
+		url, err := src.URL(vers, spec.series, spec.arch)
+		if err != nil {
+			log.Printf("cannot get URL from external tools source: %v", err)
 			continue
 		}
-		if bestVersion.Less(vers) {
-			bestVersion = vers
-			bestName = name
-		}
+		return urlToolsStorage{url}, "", true
+	}
+	return nil, "", false
+}
+
+// findToolsPath looks for the tools in the given storage.
+func findToolsPath(store StorageReader, spec toolsSpec) (path string, err error) {
+	list, err := ListTools(store, spec.vers.Major)
+	if err != nil {
+		return "", err
 	}
-	if bestVersion.Major < 0 {
-		return "", &NotFoundError{fmt.Errorf("no compatible tools found")}
+	log.Printf("findTools searching for %v in %d tools", spec, len(list))
+	best, _, err := BestTools(list, Preferences{
+		Version: spec.vers,
+		Series:  spec.series,
+		Arch:    spec.arch,
+	})
+	if err != nil {
+		return "", err
 	}
-	return bestName, nil
+	return ToolsPath(best.Version, best.Series, best.Arch), nil
 }
 
 func setenv(env []string, val string) []string {
@@ -329,16 +783,6 @@ func bundleTools(w io.Writer) error {
 	return archive(w, dir)
 }
 
-func writeFile(name string, mode os.FileMode, r io.Reader) error {
-	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = io.Copy(f, r)
-	return err
-}
-
 // EmptyStorage holds a StorageReader object that contains nothing.
 var EmptyStorage StorageReader = emptyStorage{}
 
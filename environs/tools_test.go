@@ -0,0 +1,306 @@
+package environs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/juju-core/version"
+	"os"
+	"strings"
+	"testing"
+)
+
+func mkTools(major, minor, patch int, series, arch string) *Tools {
+	return &Tools{
+		Version: version.Version{Major: major, Minor: minor, Patch: patch},
+		Series:  series,
+		Arch:    arch,
+	}
+}
+
+// fakeStorage is a minimal StorageReader backed by an in-memory map,
+// used to test hydrateManifest without a real Storage implementation.
+type fakeStorage map[string][]byte
+
+func (s fakeStorage) Get(name string) (io.ReadCloser, error) {
+	data, ok := s[name]
+	if !ok {
+		return nil, &NotFoundError{fmt.Errorf("file %q not found in fake storage", name)}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s fakeStorage) URL(name string) (string, error) {
+	return name, nil
+}
+
+func (s fakeStorage) List(prefix string) ([]string, error) {
+	var names []string
+	for name := range s {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func TestHydrateManifestPopulatesSizeAndSHA256(t *testing.T) {
+	store := fakeStorage{
+		"tools/juju-1.2.3-precise-amd64.json": mustMarshalManifest(t, &Manifest{Size: 42, SHA256: "abc123"}),
+	}
+	tools := &Tools{}
+	if err := hydrateManifest(store, "tools/juju-1.2.3-precise-amd64.tgz", tools); err != nil {
+		t.Fatalf("hydrateManifest failed: %v", err)
+	}
+	if tools.Size != 42 || tools.SHA256 != "abc123" {
+		t.Fatalf("expected manifest to be hydrated, got %#v", tools)
+	}
+}
+
+func TestHydrateManifestLeavesToolsUnchangedWhenNoneExists(t *testing.T) {
+	store := fakeStorage{}
+	tools := &Tools{}
+	if err := hydrateManifest(store, "tools/juju-1.2.3-precise-amd64.tgz", tools); err != nil {
+		t.Fatalf("hydrateManifest failed: %v", err)
+	}
+	if tools.Size != 0 || tools.SHA256 != "" {
+		t.Fatalf("expected tools to be left unhydrated, got %#v", tools)
+	}
+}
+
+func TestHydrateManifestFailsClosedWhenManifestSignatureMissing(t *testing.T) {
+	store := fakeStorage{
+		"tools/juju-1.2.3-precise-amd64.json": mustMarshalManifest(t, &Manifest{Size: 42, SHA256: "abc123"}),
+		// No signature is published at the ".asc" path, which is the
+		// case this test exists to cover.
+	}
+
+	keyringFile, err := ioutil.TempFile("", "verification-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyringFile.Name())
+	keyringFile.Close()
+
+	old := VerificationKeyring
+	VerificationKeyring = keyringFile.Name()
+	defer func() { VerificationKeyring = old }()
+
+	tools := &Tools{}
+	err = hydrateManifest(store, "tools/juju-1.2.3-precise-amd64.tgz", tools)
+	if err == nil {
+		t.Fatal("expected hydrateManifest to fail closed when the manifest signature cannot be verified")
+	}
+	if tools.Size != 0 || tools.SHA256 != "" {
+		t.Fatalf("expected tools to be left unhydrated when verification fails, got %#v", tools)
+	}
+}
+
+func mustMarshalManifest(t *testing.T, m *Manifest) []byte {
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPutToolsForSeriesRejectsABIIncompatibleSeries(t *testing.T) {
+	err := PutToolsForSeries(nil, []string{"not-a-real-series"})
+	if err == nil {
+		t.Fatal("expected PutToolsForSeries to reject a series it cannot vouch for")
+	}
+}
+
+// fakeToolsSource is a minimal ToolsSource backed by an in-memory
+// List, used to test findToolsFromSources without a real HTTP or
+// storage-backed source.
+type fakeToolsSource struct {
+	list List
+	url  string
+}
+
+func (f *fakeToolsSource) Fetch(filter Filter) (List, error) {
+	return f.list.Match(filter), nil
+}
+
+func (f *fakeToolsSource) URL(v version.Version, series, arch string) (string, error) {
+	return f.url, nil
+}
+
+func TestFindToolsPathReturnsNotFoundWhenStorageEmpty(t *testing.T) {
+	store := fakeStorage{}
+	spec := toolsSpec{vers: version.Version{Major: 1, Minor: 2, Patch: 3}, series: "precise", arch: "amd64"}
+	if _, err := findToolsPath(store, spec); err == nil {
+		t.Fatal("expected an error when storage has no matching tools")
+	} else if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("expected a *NotFoundError, got %#v", err)
+	}
+}
+
+func TestFindToolsPathFindsMatchInStorage(t *testing.T) {
+	spec := toolsSpec{vers: version.Version{Major: 1, Minor: 2, Patch: 3}, series: "precise", arch: "amd64"}
+	store := fakeStorage{
+		ToolsPath(spec.vers, spec.series, spec.arch): []byte("archive bytes"),
+	}
+	path, err := findToolsPath(store, spec)
+	if err != nil {
+		t.Fatalf("findToolsPath failed: %v", err)
+	}
+	if want := ToolsPath(spec.vers, spec.series, spec.arch); path != want {
+		t.Fatalf("expected path %q, got %q", want, path)
+	}
+}
+
+func TestFindToolsFromSourcesReturnsFirstMatch(t *testing.T) {
+	spec := toolsSpec{vers: version.Version{Major: 1, Minor: 2, Patch: 3}, series: "precise", arch: "amd64"}
+	src := &fakeToolsSource{
+		list: List{mkTools(1, 2, 3, "precise", "amd64")},
+		url:  "http://example.com/tools/juju-1.2.3-precise-amd64.tgz",
+	}
+	storage, path, ok := findToolsFromSources([]ToolsSource{src}, spec)
+	if !ok {
+		t.Fatal("expected a match from the external source")
+	}
+	if path != "" {
+		t.Fatalf("expected no in-storage path for an external-source hit, got %q", path)
+	}
+	got, err := storage.URL("")
+	if err != nil {
+		t.Fatalf("storage.URL failed: %v", err)
+	}
+	if got != src.url {
+		t.Fatalf("expected the external source's URL %q, got %q", src.url, got)
+	}
+}
+
+func TestFindToolsFromSourcesSkipsSourceWithNoMatch(t *testing.T) {
+	spec := toolsSpec{vers: version.Version{Major: 1, Minor: 2, Patch: 3}, series: "precise", arch: "amd64"}
+	empty := &fakeToolsSource{}
+	if _, _, ok := findToolsFromSources([]ToolsSource{empty}, spec); ok {
+		t.Fatal("expected no match when no source has the requested tools")
+	}
+}
+
+func TestMatchReleasedExcludesOddMinor(t *testing.T) {
+	list := List{
+		mkTools(1, 20, 0, "precise", "amd64"), // released
+		mkTools(1, 21, 0, "precise", "amd64"), // dev
+	}
+	got := list.Match(Filter{MajorVersion: 1, MinorVersion: NoFilter, Released: true})
+	if len(got) != 1 || got[0].Version.Minor != 20 {
+		t.Fatalf("expected only the released (even minor) tools, got %#v", got)
+	}
+}
+
+func TestMatchMinorVersionWildcard(t *testing.T) {
+	list := List{
+		mkTools(1, 20, 0, "precise", "amd64"),
+		mkTools(1, 21, 0, "precise", "amd64"),
+		mkTools(2, 0, 0, "precise", "amd64"),
+	}
+	got := list.Match(Filter{MajorVersion: 1, MinorVersion: NoFilter})
+	if len(got) != 2 {
+		t.Fatalf("expected both v1.* tools with the minor wildcard, got %#v", got)
+	}
+}
+
+func TestMatchExactMinorVersion(t *testing.T) {
+	list := List{
+		mkTools(1, 20, 0, "precise", "amd64"),
+		mkTools(1, 21, 0, "precise", "amd64"),
+	}
+	got := list.Match(Filter{MajorVersion: 1, MinorVersion: 21})
+	if len(got) != 1 || got[0].Version.Minor != 21 {
+		t.Fatalf("expected only the dev tools, got %#v", got)
+	}
+}
+
+func TestNewestPicksHighestVersion(t *testing.T) {
+	list := List{
+		mkTools(1, 20, 0, "precise", "amd64"),
+		mkTools(1, 20, 1, "precise", "amd64"),
+	}
+	newest, vers := list.Newest()
+	if len(newest) != 1 || vers != newest[0].Version {
+		t.Fatalf("expected a single newest entry, got %#v (%v)", newest, vers)
+	}
+	if vers.Patch != 1 {
+		t.Fatalf("expected the higher patch version to win, got %v", vers)
+	}
+}
+
+func TestBestToolsPrefersExactMatch(t *testing.T) {
+	list := List{
+		mkTools(1, 20, 0, "trusty", "amd64"),
+		mkTools(1, 20, 1, "precise", "amd64"), // would win on version if series fallback were used
+	}
+	prefs := Preferences{
+		Version:             version.Version{Major: 1},
+		Series:              "trusty",
+		Arch:                "amd64",
+		AllowSeriesFallback: true,
+	}
+	best, fallback, err := BestTools(list, prefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fallback {
+		t.Fatal("expected no fallback to be needed")
+	}
+	if best.Series != "trusty" || best.Version.Patch != 0 {
+		t.Fatalf("expected the exact trusty match, got %#v", best)
+	}
+}
+
+func TestBestToolsFallsBackToCompatibleSeries(t *testing.T) {
+	list := List{
+		mkTools(1, 20, 0, "precise", "amd64"),
+	}
+	prefs := Preferences{
+		Version:             version.Version{Major: 1},
+		Series:              "trusty",
+		Arch:                "amd64",
+		AllowSeriesFallback: true,
+	}
+	best, fallback, err := BestTools(list, prefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fallback {
+		t.Fatal("expected a fallback to have been used")
+	}
+	if best.Series != "precise" {
+		t.Fatalf("expected the precise tools as a fallback, got %#v", best)
+	}
+}
+
+func TestBestToolsRejectsFallbackWhenDisallowed(t *testing.T) {
+	list := List{
+		mkTools(1, 20, 0, "precise", "amd64"),
+	}
+	prefs := Preferences{
+		Version: version.Version{Major: 1},
+		Series:  "trusty",
+		Arch:    "amd64",
+	}
+	if _, _, err := BestTools(list, prefs); err == nil {
+		t.Fatal("expected no compatible tools without series fallback enabled")
+	}
+}
+
+func TestBestToolsArchFallbackNeverRunsAmd64OnI386(t *testing.T) {
+	list := List{
+		mkTools(1, 20, 0, "precise", "amd64"),
+	}
+	prefs := Preferences{
+		Version:           version.Version{Major: 1},
+		Series:            "precise",
+		Arch:              "i386",
+		AllowArchFallback: true,
+	}
+	if _, _, err := BestTools(list, prefs); err == nil {
+		t.Fatal("expected arch fallback not to offer amd64 tools for an i386 request")
+	}
+}
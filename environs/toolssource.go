@@ -0,0 +1,210 @@
+package environs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/juju-core/version"
+	"net/http"
+	"strings"
+)
+
+// ToolsSource abstracts a place that tools and their metadata can be
+// fetched from. findTools already knows how to look in an
+// environment's own storage and its public storage; ToolsSource lets
+// it look further afield too, at a private mirror or an air-gapped
+// internal index, without requiring that index to be repackaged into
+// the provider's own PublicStorage.
+type ToolsSource interface {
+	// Fetch returns the tools in this source that match filter.
+	Fetch(filter Filter) (List, error)
+
+	// URL returns the URL of the tools archive at the given version,
+	// series and architecture.
+	URL(v version.Version, series, arch string) (string, error)
+}
+
+// storageToolsSource adapts a StorageReader, as used by ListTools, to
+// the ToolsSource interface.
+type storageToolsSource struct {
+	store StorageReader
+}
+
+// NewStorageToolsSource returns a ToolsSource that lists tools found
+// in store.
+func NewStorageToolsSource(store StorageReader) ToolsSource {
+	return storageToolsSource{store}
+}
+
+// Fetch lists the tools of a single major version, taken from
+// filter.MajorVersion or, when that is 0, from filter.Number.Major.
+// Tools of other major versions are not listed, so a filter whose
+// MajorVersion is NoFilter matches nothing.
+func (s storageToolsSource) Fetch(filter Filter) (List, error) {
+	major := filter.MajorVersion
+	if major == 0 {
+		major = filter.Number.Major
+	}
+	list, err := ListTools(s.store, major)
+	if err != nil {
+		return nil, err
+	}
+	return list.Match(filter), nil
+}
+
+func (s storageToolsSource) URL(v version.Version, series, arch string) (string, error) {
+	return s.store.URL(ToolsPath(v, series, arch))
+}
+
+// toolsIndexPath is where a simplestreams-style tools source publishes
+// its top-level index, relative to the source's base URL.
+const toolsIndexPath = "streams/v1/index.json"
+
+// toolsProductID identifies the juju tools product within a
+// simplestreams index, in the same style as the public streams juju
+// publishes for itself.
+const toolsProductID = "com.canonical.juju-tools"
+
+// toolsIndex is the top-level simplestreams document listing the
+// paths of the individual product indexes a source publishes.
+type toolsIndex struct {
+	Index map[string]struct {
+		Path string `json:"path"`
+	} `json:"index"`
+}
+
+// toolsIndexEntry describes a single tools archive in a source's
+// product index.
+type toolsIndexEntry struct {
+	Version version.Version `json:"version"`
+	Series  string          `json:"series"`
+	Arch    string          `json:"arch"`
+	Path    string          `json:"path"`
+	Size    int64           `json:"size"`
+	SHA256  string          `json:"sha256"`
+}
+
+// toolsProductIndex is the product-specific document that toolsIndex
+// points at, listing the tools entries themselves.
+type toolsProductIndex struct {
+	Tools []toolsIndexEntry `json:"tools"`
+}
+
+// httpToolsSource is a ToolsSource that reads a signed, simplestreams-
+// style JSON index published over HTTP at baseURL.
+type httpToolsSource struct {
+	baseURL string
+}
+
+// NewHTTPToolsSource returns a ToolsSource that reads its index from
+// baseURL, so operators can point juju at a private mirror or an
+// internal tools index instead of repackaging it as the provider's
+// own public storage.
+func NewHTTPToolsSource(baseURL string) ToolsSource {
+	return httpToolsSource{strings.TrimRight(baseURL, "/")}
+}
+
+func (h httpToolsSource) Fetch(filter Filter) (List, error) {
+	entries, err := h.entries()
+	if err != nil {
+		return nil, err
+	}
+	var list List
+	for _, e := range entries {
+		list = append(list, &Tools{
+			Version: e.Version,
+			Series:  e.Series,
+			Arch:    e.Arch,
+			URL:     h.baseURL + "/" + e.Path,
+			Size:    e.Size,
+			SHA256:  e.SHA256,
+		})
+	}
+	return list.Match(filter), nil
+}
+
+func (h httpToolsSource) URL(v version.Version, series, arch string) (string, error) {
+	entries, err := h.entries()
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.Version == v && e.Series == series && e.Arch == arch {
+			return h.baseURL + "/" + e.Path, nil
+		}
+	}
+	return "", &NotFoundError{fmt.Errorf("no tools found at %s for %v-%s-%s", h.baseURL, v, series, arch)}
+}
+
+// entries fetches and parses this source's index and product index,
+// verifying each document's detached signature when VerificationKeyring
+// is set - an operator pointing juju at a private mirror or an
+// air-gapped internal index otherwise has no way to tell a genuine
+// index from one served by a compromised or mistargeted host.
+func (h httpToolsSource) entries() ([]toolsIndexEntry, error) {
+	var idx toolsIndex
+	if err := getVerifiedJSON(h.baseURL+"/"+toolsIndexPath, &idx); err != nil {
+		return nil, fmt.Errorf("cannot read tools index at %s: %v", h.baseURL, err)
+	}
+	product, ok := idx.Index[toolsProductID]
+	if !ok {
+		return nil, fmt.Errorf("tools index at %s has no %q product", h.baseURL, toolsProductID)
+	}
+	var products toolsProductIndex
+	if err := getVerifiedJSON(h.baseURL+"/"+product.Path, &products); err != nil {
+		return nil, fmt.Errorf("cannot read tools product index at %s: %v", h.baseURL, err)
+	}
+	return products.Tools, nil
+}
+
+// getVerifiedJSON fetches url, verifies its detached signature when
+// VerificationKeyring is set, and unmarshals its body into v.
+func getVerifiedJSON(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if VerificationKeyring != "" {
+		if err := verifyDetachedSignature(url, data); err != nil {
+			return fmt.Errorf("%s: %v", url, err)
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// urlToolsStorage adapts a single already-located tools URL to the
+// StorageReader interface, so findTools can hand back a hit from an
+// external ToolsSource through the same (storage, path) contract it
+// already uses for environment and public storage.
+type urlToolsStorage struct {
+	url string
+}
+
+func (u urlToolsStorage) Get(name string) (io.ReadCloser, error) {
+	resp, err := http.Get(u.url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &NotFoundError{fmt.Errorf("cannot get %q: %s", u.url, resp.Status)}
+	}
+	return resp.Body, nil
+}
+
+func (u urlToolsStorage) URL(name string) (string, error) {
+	return u.url, nil
+}
+
+func (u urlToolsStorage) List(prefix string) ([]string, error) {
+	return []string{""}, nil
+}
@@ -0,0 +1,65 @@
+package environs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTTPToolsSourceFetchesUnsignedIndexWhenNoKeyringConfigured(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/streams/v1/index.json":
+			w.Write([]byte(`{"index":{"` + toolsProductID + `":{"path":"streams/v1/products.json"}}}`))
+		case "/streams/v1/products.json":
+			w.Write([]byte(`{"tools":[{"version":"1.2.3","series":"precise","arch":"amd64","path":"tools/juju-1.2.3-precise-amd64.tgz"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	src := NewHTTPToolsSource(srv.URL)
+	entries, err := src.(httpToolsSource).entries()
+	if err != nil {
+		t.Fatalf("entries failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Series != "precise" {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+}
+
+func TestHTTPToolsSourceRejectsUnsignedIndexWhenKeyringConfigured(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/streams/v1/index.json":
+			w.Write([]byte(`{"index":{"` + toolsProductID + `":{"path":"streams/v1/products.json"}}}`))
+		default:
+			// No detached signature is published at index.json.asc,
+			// which is the case this test exists to cover.
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	keyringFile, err := ioutil.TempFile("", "verification-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyringFile.Name())
+	keyringFile.Close()
+
+	old := VerificationKeyring
+	VerificationKeyring = keyringFile.Name()
+	defer func() { VerificationKeyring = old }()
+
+	src := NewHTTPToolsSource(srv.URL)
+	if _, err := src.(httpToolsSource).entries(); err == nil {
+		t.Fatal("expected entries to fail closed on an unsigned index")
+	} else if !strings.Contains(err.Error(), "index.json") {
+		t.Fatalf("expected error to name the offending document, got: %v", err)
+	}
+}